@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DataCollector describes a single shell command to run on the remote host
+// and the name under which its output is stored in Stats.Collections.
+type DataCollector struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+
+	// Sudo overrides the host's default Section.Sudo for this collector
+	// alone. A nil Sudo means "inherit the host default"; this lets a
+	// collector opt out of sudo even when the host has it on by default.
+	Sudo     *bool  `yaml:"sudo"`
+	SudoUser string `yaml:"sudoUser"`
+}
+
+// Stats holds the result of one collection round for a single host.
+type Stats struct {
+	Time        time.Time
+	Name        string
+	Collections map[string]interface{}
+}
+
+// getAllStats runs every configured DataCollector against client and
+// stores its raw output in stats.Collections, keyed by collector name.
+func getAllStats(client *ssh.Client, stats *Stats, dataCollectors []DataCollector, host Section) error {
+	for _, dc := range dataCollectors {
+		cmd := collectorCommand(dc, host)
+		out, err := runCommand(client, cmd)
+		if err != nil {
+			return fmt.Errorf("collector %q failed: %w", dc.Name, err)
+		}
+		stats.Collections[dc.Name] = out
+	}
+	return nil
+}
+
+// collectorCommand builds the command to actually run for dc, wrapping it
+// in sudo when either the collector or its host calls for that.
+func collectorCommand(dc DataCollector, host Section) string {
+	useSudo := host.Sudo
+	if dc.Sudo != nil {
+		useSudo = *dc.Sudo
+	}
+	if !useSudo {
+		return dc.Command
+	}
+
+	sudoUser := dc.SudoUser
+	if len(sudoUser) == 0 {
+		sudoUser = host.SudoUser
+	}
+	if len(sudoUser) == 0 {
+		sudoUser = "root"
+	}
+	return fmt.Sprintf("sudo -n -u %s -- sh -c %s", sudoUser, quoteShellArg(dc.Command))
+}
+
+// quoteShellArg wraps s in single quotes for safe passing as one shell
+// argument, escaping any single quotes it contains.
+func quoteShellArg(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// preflightSudo runs `sudo -n whoami` as host.SudoUser once per host that
+// has Sudo enabled, so a missing NOPASSWD rule is reported clearly up
+// front instead of surfacing as a confusing failure from the first
+// collector that needs it.
+func preflightSudo(client *ssh.Client, host Section) error {
+	if !host.Sudo {
+		return nil
+	}
+	sudoUser := host.SudoUser
+	if len(sudoUser) == 0 {
+		sudoUser = "root"
+	}
+	out, err := runCommand(client, fmt.Sprintf("sudo -n -u %s whoami", sudoUser))
+	if err != nil {
+		return fmt.Errorf("passwordless sudo to %s not available on %s: %s (%s)", sudoUser, host.Hostname, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// runCommand executes cmd on client over a fresh SSH session and returns
+// its combined stdout and stderr.
+func runCommand(client *ssh.Client, cmd string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return string(out), err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// StartHTTPServer starts the rtop dashboard and JSON query API on addr,
+// serving data out of baseDir (normally "timeSeries") and collectionsDir
+// (normally "collections"). It runs in the background and is never
+// stopped; like the rest of rtop, it lives for the process's lifetime.
+func StartHTTPServer(addr, baseDir, collectionsDir string) {
+	mux := http.NewServeMux()
+
+	api := &httpAPI{baseDir: baseDir, collectionsDir: collectionsDir}
+	mux.HandleFunc("/api/hosts", api.handleHosts)
+	mux.HandleFunc("/api/hosts/", api.handleHostSubroute)
+	mux.HandleFunc("/api/collections/", api.handleCollection)
+
+	if sub, err := fs.Sub(dashboardFS, "dashboard"); err == nil {
+		mux.Handle("/", http.FileServer(http.FS(sub)))
+	}
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("http dashboard: %s\n", err)
+		}
+	}()
+}
+
+type httpAPI struct {
+	baseDir        string
+	collectionsDir string
+}
+
+// handleHosts lists every host directory under baseDir.
+func (a *httpAPI) handleHosts(w http.ResponseWriter, r *http.Request) {
+	entries, err := ioutil.ReadDir(a.baseDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var hosts []string
+	for _, e := range entries {
+		if e.IsDir() {
+			hosts = append(hosts, e.Name())
+		}
+	}
+	writeJSON(w, hosts)
+}
+
+// handleHostSubroute dispatches /api/hosts/{host}/latest and
+// /api/hosts/{host}/range.
+func (a *httpAPI) handleHostSubroute(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/hosts/")
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	host, action := parts[0], parts[1]
+
+	switch action {
+	case "latest":
+		a.handleHostLatest(w, r, host)
+	case "range":
+		a.handleHostRange(w, r, host)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleHostLatest returns the most recent Stats collected for host.
+func (a *httpAPI) handleHostLatest(w http.ResponseWriter, r *http.Request, host string) {
+	dir := filepath.Join(a.baseDir, host)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var latestRaw string
+	var latestTime int64
+	for _, e := range entries {
+		m := rawFileTimeRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		ts, _ := strconv.ParseInt(m[1], 10, 64)
+		if ts > latestTime {
+			latestTime = ts
+			latestRaw = e.Name()
+		}
+	}
+	if len(latestRaw) > 0 {
+		content, err := ioutil.ReadFile(filepath.Join(dir, latestRaw))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content)
+		return
+	}
+
+	// fall back to the most recent line in the most recent shard
+	shard := latestShard(entries)
+	if len(shard) == 0 {
+		http.Error(w, "no data for host", http.StatusNotFound)
+		return
+	}
+	lines, err := readShardLines(filepath.Join(dir, shard))
+	if err != nil || len(lines) == 0 {
+		http.Error(w, "no data for host", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(lines[len(lines)-1]))
+}
+
+func latestShard(entries []os.FileInfo) string {
+	var latest string
+	for _, e := range entries {
+		if shardHourRe.MatchString(e.Name()) && e.Name() > latest {
+			latest = e.Name()
+		}
+	}
+	return latest
+}
+
+// handleHostRange streams, as NDJSON, every sample for host between the
+// from/to unix-second query parameters (inclusive), optionally narrowed
+// to a single collector's value, reading transparently through both raw
+// per-interval files and compacted gzip shards.
+func (a *httpAPI) handleHostRange(w http.ResponseWriter, r *http.Request, host string) {
+	from, to, err := parseRangeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	collector := r.URL.Query().Get("collector")
+
+	dir := filepath.Join(a.baseDir, host)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	// raw files first
+	var raw []os.FileInfo
+	for _, e := range entries {
+		if rawFileTimeRe.MatchString(e.Name()) {
+			raw = append(raw, e)
+		}
+	}
+	sort.Slice(raw, func(i, j int) bool { return raw[i].Name() < raw[j].Name() })
+	for _, e := range raw {
+		m := rawFileTimeRe.FindStringSubmatch(e.Name())
+		ts, _ := strconv.ParseInt(m[1], 10, 64)
+		if ts < from || ts > to {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		writeRangeLine(w, content, collector)
+	}
+
+	// then every shard, keeping only the lines within [from, to]
+	var shards []string
+	for _, e := range entries {
+		if shardHourRe.MatchString(e.Name()) {
+			shards = append(shards, e.Name())
+		}
+	}
+	sort.Strings(shards)
+	for _, name := range shards {
+		lines, err := readShardLines(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		for _, line := range lines {
+			if !lineInRange([]byte(line), from, to) {
+				continue
+			}
+			writeRangeLine(w, []byte(line), collector)
+		}
+	}
+}
+
+// lineInRange reports whether a shard's NDJSON line falls within
+// [from, to] (unix seconds, inclusive), read from the line's own
+// Stats.Time rather than the shard's hour, since a shard can carry lines
+// folded in across more than one compaction run.
+func lineInRange(line []byte, from, to int64) bool {
+	var s struct {
+		Time time.Time
+	}
+	if err := json.Unmarshal(line, &s); err != nil {
+		return false
+	}
+	ts := s.Time.Unix()
+	return ts >= from && ts <= to
+}
+
+// writeRangeLine decodes a single Stats JSON document and writes it (or
+// just the requested collector's value) as one NDJSON line.
+func writeRangeLine(w http.ResponseWriter, raw []byte, collector string) {
+	if len(collector) == 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return
+		}
+		buf.WriteByte('\n')
+		w.Write(buf.Bytes())
+		return
+	}
+	var s Stats
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return
+	}
+	value, ok := s.Collections[collector]
+	if !ok {
+		return
+	}
+	line, err := json.Marshal(map[string]interface{}{
+		"time":  s.Time,
+		"name":  s.Name,
+		"value": value,
+	})
+	if err != nil {
+		return
+	}
+	w.Write(line)
+	w.Write([]byte("\n"))
+}
+
+func parseRangeParams(r *http.Request) (from int64, to int64, err error) {
+	from = 0
+	to = 1<<63 - 1
+	if v := r.URL.Query().Get("from"); len(v) > 0 {
+		from, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad from: %w", err)
+		}
+	}
+	if v := r.URL.Query().Get("to"); len(v) > 0 {
+		to, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad to: %w", err)
+		}
+	}
+	return from, to, nil
+}
+
+// handleCollection returns every host's result for a -n named collection,
+// keyed by host.
+func (a *httpAPI) handleCollection(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/collections/")
+	if len(name) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := ioutil.ReadDir(a.collectionsDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	prefix := name + "-"
+	result := make(map[string]json.RawMessage)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(e.Name(), prefix), ".json")
+		content, err := ioutil.ReadFile(filepath.Join(a.collectionsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		result[host] = json.RawMessage(content)
+	}
+	if len(result) == 0 {
+		http.Error(w, "no such collection", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(v)
+}
@@ -26,7 +26,6 @@ THE SOFTWARE.
 package main
 
 import (
-
 	"encoding/json"
 	"gopkg.in/yaml.v2"
 
@@ -37,6 +36,7 @@ import (
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -44,10 +44,6 @@ import (
 
 	"golang.org/x/crypto/ssh"
 
-	"crypto/rsa"
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
 	"io/ioutil"
 )
 
@@ -64,16 +60,35 @@ func usage(code int) {
 		`rtop %s - (c) 2015 RapidLoop - MIT Licensed - http://rtop-monitor.org
 rtop monitors server statistics over an ssh connection
 
-Usage: rtop [-i private-key-file] [-t interval] [-n namedCollection] [user@]host[:port]
+Usage: rtop [-i private-key-file] [-t interval] [-n namedCollection] [-k] [user@]host[:port]
 
 	-i private-key-file
-		PEM-encoded private key file to use (default: ~/.ssh/id_rsa if present)
+		PEM-encoded private key file to use (default: ~/.ssh/id_ed25519 or
+		~/.ssh/id_rsa, whichever is present; falls back to ssh-agent)
 	[user@]host[:port]
 		the SSH server to connect to, with optional username and port
 	-t interval
 		refresh interval in seconds (default: %d)
 	-n namedCollection
 		collect a single named checkpoint collection instead of continuous collections
+	-k
+		skip known_hosts verification and accept any host key (first-time bootstrap only)
+	-password
+		authenticate with an interactive password prompt instead of a key or
+		ssh-agent; applies to every host on the command line (there is no
+		per-host YAML equivalent -- hosts are specified on the command line,
+		not in the YAML config file)
+	-sudo
+		run collector commands via passwordless sudo
+	-sudo-user user
+		user to sudo to when -sudo is set (default: root)
+	-p N
+		number of hosts to collect from concurrently in -n mode, and to dial at once on startup
+		otherwise (default: min(NumCPU*2, host count))
+	-compact
+		one-shot: apply the configured retention policy to every host under timeSeries/ and exit
+	-http listen-address
+		serve a dashboard and JSON query API over the collected time series, e.g. -http :8080
 
 `, VERSION, DEFAULT_REFRESH)
 	os.Exit(code)
@@ -88,9 +103,9 @@ func shift(q []string) (ok bool, val string, qnew []string) {
 	return
 }
 
-func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, onlyBootstrap bool, namedCollection string, testFile string) {
+func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, onlyBootstrap bool, namedCollection string, testFile string, insecureHostKey bool, sudo bool, sudoUser string, poolSize int, compactOnly bool, httpAddr string, authMethod string) {
 	ok, arg, args := shift(os.Args)
-	var argKey,  argInt string
+	var argKey, argInt, argPool string
 	bootstrap = false
 	onlyBootstrap = false
 	namedCollection = "NOT_A_NAMED_COLLECTION"
@@ -114,8 +129,31 @@ func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, on
 		} else if arg == "-B" {
 			bootstrap = true
 			onlyBootstrap = true
+		} else if arg == "-k" {
+			insecureHostKey = true
+		} else if arg == "-password" {
+			authMethod = "password"
+		} else if arg == "-sudo" {
+			sudo = true
+		} else if arg == "-sudo-user" {
+			ok, sudoUser, args = shift(args)
+			if !ok {
+				usage(1)
+			}
 		} else if arg == "-t" {
 			argInt = arg
+		} else if arg == "-compact" {
+			compactOnly = true
+		} else if arg == "-http" {
+			ok, httpAddr, args = shift(args)
+			if !ok {
+				usage(1)
+			}
+		} else if arg == "-p" {
+			ok, argPool, args = shift(args)
+			if !ok {
+				usage(1)
+			}
 		} else if arg == "-n" {
 			ok, namedCollection, args = shift(args)
 			if !ok {
@@ -130,7 +168,7 @@ func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, on
 			hostStrings = append(hostStrings, arg)
 		}
 	}
-	if len(hostStrings) == 0 {
+	if len(hostStrings) == 0 && !compactOnly && len(httpAddr) == 0 {
 		usage(1)
 	}
 
@@ -213,12 +251,15 @@ func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, on
 			username = currentUser.Username
 		}
 		if len(key) == 0 {
+			idEd25519p := filepath.Join(currentUser.HomeDir, ".ssh", "id_ed25519")
 			idrsap := filepath.Join(currentUser.HomeDir, ".ssh", "id_rsa")
-			if _, err := os.Stat(idrsap); err == nil {
+			if _, err := os.Stat(idEd25519p); err == nil {
+				key = idEd25519p
+			} else if _, err := os.Stat(idrsap); err == nil {
 				key = idrsap
 			}
 		}
-		hosts = append(hosts, Section{ host, port, username, key })
+		hosts = append(hosts, Section{Hostname: host, Port: port, User: username, IdentityFile: key, AuthMethod: authMethod, InsecureHostKey: insecureHostKey, Sudo: sudo, SudoUser: sudoUser})
 	}
 
 	// interval
@@ -235,6 +276,24 @@ func parseCmdLine() (hosts []Section, interval time.Duration, bootstrap bool, on
 		interval = time.Duration(i) * time.Second
 	} // else interval remains 0
 
+	// worker pool size
+	if len(argPool) > 0 {
+		i, err := strconv.Atoi(argPool)
+		if err != nil || i <= 0 {
+			log.Printf("bad pool size: %s", argPool)
+			usage(1)
+		}
+		poolSize = i
+	} else {
+		poolSize = runtime.NumCPU() * 2
+	}
+	if poolSize > len(hosts) {
+		poolSize = len(hosts)
+	}
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
 	return
 }
 
@@ -246,7 +305,7 @@ func main() {
 	log.SetFlags(0)
 
 	// get params from command line
-	hosts, interval, bootstrap, onlyBootstrap, namedCollection, testFile := parseCmdLine()
+	hosts, interval, bootstrap, onlyBootstrap, namedCollection, testFile, _, _, _, poolSize, compactOnly, httpAddr, _ := parseCmdLine()
 	// log.Printf("cmdline: %s %d %s %s", host, port, username, key)
 	if interval == 0 {
 		interval = DEFAULT_REFRESH * time.Second
@@ -258,29 +317,11 @@ func main() {
 		var privateKeyString string
 		if _, err := os.Stat("bootstrap.key"); os.IsNotExist(err) {
 			if _, err := os.Stat("bootstrap.key.pub"); os.IsNotExist(err) {
-				privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+				privateKeyBin, err := generateBootstrapKey()
 				if err != nil {
-					fmt.Printf("Bootstrapping failed: %s\n", err);
+					fmt.Printf("Bootstrapping failed: %s\n", err)
 					os.Exit(1)
 				}
-				privateKeyFile, err := os.Create("bootstrap.key")
-				defer privateKeyFile.Close()
-				if err != nil {
-					fmt.Printf("Bootstrapping failed: %s\n", err);
-					os.Exit(1)
-				}
-				privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-				if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
-					fmt.Printf("Bootstrapping failed: %s\n", err);
-					os.Exit(1)
-				}
-				pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
-				if err != nil {
-					fmt.Printf("Bootstrapping failed: %s\n", err);
-					os.Exit(1)
-				}
-				privateKeyBin := ssh.MarshalAuthorizedKey(pub)
-				ioutil.WriteFile("bootstrap.key.pub", privateKeyBin, 0655)
 				privateKeyString = fmt.Sprintf("%s", privateKeyBin)
 			} else {
 				fmt.Println("bootstrap.key.pub exists but bootstrap.key does not exist. Either put bootstrap.key back or clean up bootstrap.key.pub and rerun bootstrap")
@@ -316,7 +357,7 @@ func main() {
 		}
 	}
 
-	var dataCollectors []DataCollector
+	var config Config
 	if testFile != "NO_TEST_FILE" {
 
 		yamlFile, err := ioutil.ReadFile(testFile)
@@ -324,14 +365,28 @@ func main() {
 			fmt.Printf("ERROR cannot read yaml file: %s\n", err)
 			os.Exit(1)
 		}
-		err = yaml.Unmarshal(yamlFile, &dataCollectors)
+		err = yaml.Unmarshal(yamlFile, &config)
 		if err != nil {
 			fmt.Printf("ERROR cannot unmarshal yaml: %s\n", err)
 			os.Exit(1)
 		}
-	} else {
-		dataCollectors = make([]DataCollector, 0)
 	}
+	dataCollectors := config.DataCollectors
+
+	if compactOnly {
+		if err := compactTimeSeriesTree("timeSeries", config.Retention); err != nil {
+			fmt.Printf("ERROR compaction failed: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	sinks, err := NewSinks(config.Sinks)
+	if err != nil {
+		fmt.Printf("ERROR cannot construct sinks: %s\n", err)
+		os.Exit(1)
+	}
+	defer closeAll(sinks)
 
 	if namedCollection != "NOT_A_NAMED_COLLECTION" {
 		if _, err := os.Stat("collections"); os.IsNotExist(err) {
@@ -340,24 +395,78 @@ func main() {
 				fmt.Printf("Error creating timeSeries directory: %s", err)
 			}
 		}
-		for _, host := range hosts {
-			//TODO make this parallellized with a sync.WaitGroup
-			singleCollection(host, dataCollectors, namedCollection)
+		results := make([]collectionResult, len(hosts))
+		pool := NewPool(poolSize)
+		pool.Run(len(hosts), func(i int) {
+			host := hosts[i]
+			start := time.Now()
+			bytesWritten, err := singleCollection(host, dataCollectors, sinks, namedCollection)
+			results[i] = collectionResult{
+				Host:         host.Hostname,
+				Duration:     time.Since(start),
+				BytesWritten: bytesWritten,
+				Err:          err,
+			}
+		})
+		failed := printCollectionSummary(results)
+		if failed {
+			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
+	if len(httpAddr) > 0 {
+		StartHTTPServer(httpAddr, "timeSeries", "collections")
+	}
+
+	// bound the initial burst of SSH dials the same way -n bounds its
+	// worker pool, so starting rtop against dozens of hosts doesn't open
+	// dozens of connections in the same instant
+	startupPool := NewPool(poolSize)
 	for _, host := range hosts {
-		go mainLoop(host, interval, dataCollectors)
+		go mainLoop(host, interval, dataCollectors, sinks, startupPool, config.Retention)
 	}
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	<-sig
 }
 
-func bootstrapper( host Section, privateKeyString string ) {
+// collectionResult summarizes one host's pass through a -n named
+// collection: how long it took, how much it wrote, and whether it failed.
+type collectionResult struct {
+	Host         string
+	Duration     time.Duration
+	BytesWritten int64
+	Err          error
+}
+
+// printCollectionSummary prints a final table of per-host results and
+// reports whether any host failed.
+func printCollectionSummary(results []collectionResult) bool {
+	failed := false
+	fmt.Printf("%-30s %12s %12s %s\n", "HOST", "DURATION", "BYTES", "ERROR")
+	for _, r := range results {
+		errStr := ""
+		if r.Err != nil {
+			errStr = r.Err.Error()
+			failed = true
+		}
+		fmt.Printf("%-30s %12s %12d %s\n", r.Host, r.Duration.Round(time.Millisecond), r.BytesWritten, errStr)
+	}
+	return failed
+}
+
+// Config is the top-level shape of the YAML file passed via -f: the list
+// of commands to run on each host, plus where their results should go.
+type Config struct {
+	DataCollectors []DataCollector `yaml:"dataCollectors"`
+	Sinks          []SinkConfig    `yaml:"sinks"`
+	Retention      RetentionPolicy `yaml:"retention"`
+}
+
+func bootstrapper(host Section, privateKeyString string) {
 	addr := fmt.Sprintf("%s:%d", host.Hostname, host.Port)
-	client := sshConnect(host.User, addr, host.IdentityFile)
+	client := sshConnect(host.User, addr, host.IdentityFile, host.AuthMethod, host.InsecureHostKey)
 	if client == nil {
 		fmt.Printf("Could not bootstrap %s", addr)
 		return
@@ -377,54 +486,75 @@ func bootstrapper( host Section, privateKeyString string ) {
 	client.Close()
 }
 
-//TODO add returning of an error for better error handling
-func singleCollection( host Section, dataCollectors []DataCollector, name string) {
+// maxConnectRetries bounds sshConnectRetry's exponential backoff for a
+// single host in the -n worker pool.
+const maxConnectRetries = 4
+
+// singleCollection connects to host, runs a single named checkpoint
+// collection, and writes it to both collections/<name>-<host>.json and
+// the configured sinks. It returns the number of bytes written to the
+// collections file and any error encountered.
+func singleCollection(host Section, dataCollectors []DataCollector, sinks []Sink, name string) (int64, error) {
 	addr := fmt.Sprintf("%s:%d", host.Hostname, host.Port)
-	client := sshConnect(host.User, addr, host.IdentityFile)
+	client := sshConnectRetry(host.User, addr, host.IdentityFile, host.AuthMethod, host.InsecureHostKey, maxConnectRetries)
 	if client == nil {
-		fmt.Println("Connection failed")
-		return
+		return 0, fmt.Errorf("connection failed")
+	}
+	defer client.Close()
+	if err := preflightSudo(client, host); err != nil {
+		return 0, err
 	}
 
 	stats := Stats{}
 	stats.Time = time.Now()
 	stats.Name = name
 	stats.Collections = make(map[string]interface{})
-	err := getAllStats(client, &stats, dataCollectors)
+	err := getAllStats(client, &stats, dataCollectors, host)
 	if err != nil {
-		return
+		return 0, err
 	}
 	file, err := json.MarshalIndent(stats, "", " ")
 	if err != nil {
-		return
+		return 0, err
 	}
 	err = ioutil.WriteFile(fmt.Sprintf("collections/%s-%s.json", name, host.Hostname), file, 0644)
 	if err != nil {
-		return
+		return 0, err
 	}
+	writeAll(sinks, host.Hostname, stats)
+	return int64(len(file)), nil
 }
 
-func mainLoop( host Section, interval time.Duration, dataCollectors []DataCollector ) {
+func mainLoop(host Section, interval time.Duration, dataCollectors []DataCollector, sinks []Sink, startupPool *Pool, retention RetentionPolicy) {
 	addr := fmt.Sprintf("%s:%d", host.Hostname, host.Port)
+	if retention.Enabled() {
+		go runRetention(filepath.Join("timeSeries", host.Hostname), retention, nil)
+	}
 	mainLoopDone := false
+	firstConnect := true
 	for !mainLoopDone {
 		fmt.Println("mainLoop")
 		nanoSeconds := time.Now().String()
 		fmt.Printf("time: %v\n", string(nanoSeconds))
-		client := sshConnect(host.User, addr, host.IdentityFile)
+		if firstConnect {
+			startupPool.Acquire()
+		}
+		client := sshConnect(host.User, addr, host.IdentityFile, host.AuthMethod, host.InsecureHostKey)
+		if firstConnect {
+			startupPool.Release()
+			firstConnect = false
+		}
 		if client == nil {
 			fmt.Println("Connection failed")
 			time.Sleep(15 * time.Second)
 			continue
 		}
-
-		tsDir := fmt.Sprintf("timeSeries/%s", host.Hostname)
-		if _, err := os.Stat(tsDir); os.IsNotExist(err) {
-			err := os.Mkdir(tsDir, 0755)
-			if err != nil {
-				fmt.Printf("Error creating timeSeries directory: %s", err)
-			}
+		if err := preflightSudo(client, host); err != nil {
+			fmt.Println(err)
+			time.Sleep(15 * time.Second)
+			continue
 		}
+
 		output := getOutput()
 		// the loop
 		//showStats(output, client, dbclient, host)
@@ -434,7 +564,7 @@ func mainLoop( host Section, interval time.Duration, dataCollectors []DataCollec
 			<-timer
 			nanoSeconds = time.Now().String()
 			fmt.Printf("time: %v\n", string(nanoSeconds))
-			err := showStats(output, client, host.Hostname, dataCollectors)
+			err := showStats(output, client, host.Hostname, dataCollectors, sinks, host)
 			if err != nil {
 				done = true
 				fmt.Printf("show Stats Error  %s: %s\n", host.Hostname, err)
@@ -446,30 +576,23 @@ func mainLoop( host Section, interval time.Duration, dataCollectors []DataCollec
 	}
 }
 
-func showStats(output io.Writer, client *ssh.Client, host string, dataCollectors []DataCollector) error {
+func showStats(output io.Writer, client *ssh.Client, host string, dataCollectors []DataCollector, sinks []Sink, section Section) error {
 	stats := Stats{}
 	stats.Time = time.Now()
 	stats.Name = strconv.FormatInt(stats.Time.Unix(), 10)
 	stats.Collections = make(map[string]interface{})
-	err := getAllStats(client, &stats, dataCollectors)
-	if err != nil {
-		return err
-	}
-	file, err := json.MarshalIndent(stats, "", " ")
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(fmt.Sprintf("timeSeries/%s/%d.json", host, stats.Time.Unix()), file, 0644)
+	err := getAllStats(client, &stats, dataCollectors, section)
 	if err != nil {
 		return err
 	}
+	writeAll(sinks, host, stats)
 	//used := stats.MemTotal - stats.MemFree - stats.MemBuffers - stats.MemCached
 	return nil
 }
 
 const (
-	escClear   = "\033[H\033[2J"
-	escRed     = "\033[31m"
-	escReset   = "\033[0m"
+	escClear       = "\033[H\033[2J"
+	escRed         = "\033[31m"
+	escReset       = "\033[0m"
 	escBrightWhite = "\033[37;1m"
 )
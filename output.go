@@ -0,0 +1,11 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// getOutput returns the writer that per-host status lines are printed to.
+func getOutput() io.Writer {
+	return os.Stdout
+}
@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// Pool bounds concurrency via a buffered channel used as a semaphore. The
+// same Pool can both fan out a batch of work with Run (used by the -n
+// named-collection path) and gate individual Acquire/Release pairs (used
+// to bound the burst of SSH dials when mainLoop starts up many hosts at
+// once).
+type Pool struct {
+	sem chan struct{}
+}
+
+// NewPool creates a Pool allowing at most concurrency operations at a
+// time. concurrency is clamped to at least 1.
+func NewPool(concurrency int) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Pool{sem: make(chan struct{}, concurrency)}
+}
+
+// Acquire blocks until a slot is free.
+func (p *Pool) Acquire() {
+	p.sem <- struct{}{}
+}
+
+// Release frees a slot acquired with Acquire.
+func (p *Pool) Release() {
+	<-p.sem
+}
+
+// Run calls fn(i) for every i in [0, n), running at most the pool's
+// concurrency at once, and blocks until all calls have returned.
+func (p *Pool) Run(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		p.Acquire()
+		go func(i int) {
+			defer wg.Done()
+			defer p.Release()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy configures how a host's timeSeries directory is rotated
+// and pruned. An empty policy (the zero value) disables retention
+// entirely, preserving rtop's historical behavior of keeping every file
+// forever.
+type RetentionPolicy struct {
+	MaxAge       string `yaml:"max_age"`
+	MaxFiles     int    `yaml:"max_files"`
+	CompactAfter string `yaml:"compact_after"`
+}
+
+// Enabled reports whether any retention setting was configured.
+func (p RetentionPolicy) Enabled() bool {
+	return len(p.MaxAge) > 0 || p.MaxFiles > 0 || len(p.CompactAfter) > 0
+}
+
+func (p RetentionPolicy) maxAge() (time.Duration, error) {
+	if len(p.MaxAge) == 0 {
+		return 0, nil
+	}
+	return parseFlexDuration(p.MaxAge)
+}
+
+func (p RetentionPolicy) compactAfter() (time.Duration, error) {
+	if len(p.CompactAfter) == 0 {
+		return time.Hour, nil
+	}
+	return parseFlexDuration(p.CompactAfter)
+}
+
+// parseFlexDuration extends time.ParseDuration with a "d" (day) unit, so
+// policies can be written as "7d" rather than "168h".
+func parseFlexDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q: %w", s, err)
+		}
+		return time.Duration(days * 24 * float64(time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// rawFileTimeRe matches the per-interval filenames showStats writes:
+// <unix-seconds>.json
+var rawFileTimeRe = regexp.MustCompile(`^(\d+)\.json$`)
+
+// shardHourRe matches compacted shard filenames: 2006-01-02T15.ndjson.gz
+var shardHourRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\d{2})\.ndjson\.gz$`)
+
+const shardHourLayout = "2006-01-02T15"
+
+// runRetention runs compaction and pruning for a single host's timeSeries
+// directory on a fixed tick until stop is closed. It's started once per
+// host alongside mainLoop when a retention policy is configured.
+func runRetention(dir string, policy RetentionPolicy, stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	applyRetention(dir, policy) // run once immediately, then on each tick
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			applyRetention(dir, policy)
+		}
+	}
+}
+
+// applyRetention compacts files older than policy's compact_after into
+// hourly gzip NDJSON shards, then deletes anything -- raw file or shard --
+// older than max_age. It no-ops on an unconfigured (zero-value) policy.
+func applyRetention(dir string, policy RetentionPolicy) {
+	if !policy.Enabled() {
+		return
+	}
+	compactAfter, err := policy.compactAfter()
+	if err != nil {
+		fmt.Printf("retention: %s\n", err)
+		return
+	}
+	if err := compactOldFiles(dir, compactAfter); err != nil {
+		fmt.Printf("retention: compaction failed for %s: %s\n", dir, err)
+	}
+
+	maxAge, err := policy.maxAge()
+	if err != nil {
+		fmt.Printf("retention: %s\n", err)
+		return
+	}
+	if maxAge > 0 {
+		if err := pruneOlderThan(dir, maxAge); err != nil {
+			fmt.Printf("retention: pruning failed for %s: %s\n", dir, err)
+		}
+	}
+	if policy.MaxFiles > 0 {
+		if err := enforceMaxFiles(dir, policy.MaxFiles); err != nil {
+			fmt.Printf("retention: max_files enforcement failed for %s: %s\n", dir, err)
+		}
+	}
+}
+
+// compactOldFiles folds every raw per-interval JSON file older than
+// compactAfter into its hourly NDJSON shard, writing each shard to a temp
+// file and renaming it into place atomically so a concurrent mainLoop
+// writer never observes a partial shard.
+func compactOldFiles(dir string, compactAfter time.Duration) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-compactAfter)
+	byHour := make(map[string][]string) // hour -> raw file names to fold in
+
+	for _, e := range entries {
+		m := rawFileTimeRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		unixSeconds, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(unixSeconds, 0)
+		if t.After(cutoff) {
+			continue
+		}
+		hour := t.UTC().Format(shardHourLayout)
+		byHour[hour] = append(byHour[hour], e.Name())
+	}
+
+	for hour, files := range byHour {
+		if err := foldIntoShard(dir, hour, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foldIntoShard appends the given raw files (as NDJSON lines) to the
+// shard for hour, then removes the raw files.
+func foldIntoShard(dir, hour string, files []string) error {
+	sort.Strings(files)
+	shardPath := filepath.Join(dir, hour+".ndjson.gz")
+	tmpPath := shardPath + ".tmp"
+
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(tmp)
+
+	// carry forward any lines already compacted for this hour
+	if existing, err := readShardLines(shardPath); err == nil {
+		for _, line := range existing {
+			if _, err := gz.Write([]byte(line + "\n")); err != nil {
+				gz.Close()
+				tmp.Close()
+				return err
+			}
+		}
+	}
+
+	for _, name := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		line := strings.ReplaceAll(strings.TrimSpace(string(content)), "\n", "")
+		if _, err := gz.Write([]byte(line + "\n")); err != nil {
+			gz.Close()
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, shardPath); err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		os.Remove(filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// readShardLines returns the NDJSON lines already stored in an existing
+// gzip shard, or an error if the shard doesn't exist or can't be read.
+func readShardLines(shardPath string) ([]string, error) {
+	f, err := os.Open(shardPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(gz)
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 10*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// pruneOlderThan deletes raw files and shards whose timestamp is older
+// than maxAge.
+func pruneOlderThan(dir string, maxAge time.Duration) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, e := range entries {
+		if m := rawFileTimeRe.FindStringSubmatch(e.Name()); m != nil {
+			unixSeconds, _ := strconv.ParseInt(m[1], 10, 64)
+			if time.Unix(unixSeconds, 0).Before(cutoff) {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+			continue
+		}
+		if m := shardHourRe.FindStringSubmatch(e.Name()); m != nil {
+			t, err := time.Parse(shardHourLayout, m[1])
+			if err == nil && t.Before(cutoff) {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// enforceMaxFiles folds the oldest raw files into their shards immediately
+// (ignoring compact_after) whenever the raw file count exceeds maxFiles,
+// keeping a runaway collection interval from filling the directory.
+func enforceMaxFiles(dir string, maxFiles int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var raw []string
+	for _, e := range entries {
+		if rawFileTimeRe.MatchString(e.Name()) {
+			raw = append(raw, e.Name())
+		}
+	}
+	if len(raw) <= maxFiles {
+		return nil
+	}
+	sort.Strings(raw)
+	excess := raw[:len(raw)-maxFiles]
+
+	byHour := make(map[string][]string)
+	for _, name := range excess {
+		m := rawFileTimeRe.FindStringSubmatch(name)
+		unixSeconds, _ := strconv.ParseInt(m[1], 10, 64)
+		hour := time.Unix(unixSeconds, 0).UTC().Format(shardHourLayout)
+		byHour[hour] = append(byHour[hour], name)
+	}
+	for hour, files := range byHour {
+		if err := foldIntoShard(dir, hour, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactTimeSeriesTree walks every host directory under baseDir and
+// applies policy once. Used by the -compact one-shot CLI mode to migrate
+// historical data after retention is first configured. It no-ops on an
+// unconfigured (zero-value) policy, matching mainLoop's runRetention.
+func compactTimeSeriesTree(baseDir string, policy RetentionPolicy) error {
+	if !policy.Enabled() {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		hostDir := filepath.Join(baseDir, e.Name())
+		fmt.Printf("compacting %s\n", hostDir)
+		applyRetention(hostDir, policy)
+	}
+	return nil
+}
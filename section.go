@@ -0,0 +1,29 @@
+package main
+
+// Section describes one target host to monitor, as built up from the
+// command line, ~/.ssh/config, and defaults.
+type Section struct {
+	Hostname     string
+	Port         int
+	User         string
+	IdentityFile string
+
+	// AuthMethod selects how to authenticate when no usable identity file
+	// or ssh-agent key is found. Currently only "password" is recognized;
+	// anything else falls through to the public-key/agent chain. Set from
+	// the global -password CLI flag, which applies to every Section built
+	// from that invocation -- hosts are specified on the command line, not
+	// in the YAML config file, so there is no per-host equivalent.
+	AuthMethod string
+
+	// InsecureHostKey skips known_hosts verification, accepting whatever
+	// host key the server presents. Intended for first-time bootstrap
+	// only (-k).
+	InsecureHostKey bool
+
+	// Sudo, if set, wraps every collector command for this host in
+	// `sudo -n -u SudoUser -- sh -c '<cmd>'` unless a collector opts out.
+	// SudoUser defaults to "root" when empty.
+	Sudo     bool
+	SudoUser string
+}
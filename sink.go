@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Sink receives a Stats collection for a host and persists or exports it
+// somewhere. Implementations must be safe for concurrent use, since the
+// same Sink instances are shared across the per-host collection goroutines.
+type Sink interface {
+	Write(host string, s Stats) error
+	Close() error
+}
+
+// SinkConfig is the YAML shape for a single configured sink, alongside
+// DataCollectors in the same collectors file.
+type SinkConfig struct {
+	Type string `yaml:"type"`
+
+	// file
+	Dir string `yaml:"dir"`
+
+	// influxdb
+	URL      string `yaml:"url"`
+	Database string `yaml:"database"`
+
+	// prometheus
+	Listen string `yaml:"listen"`
+
+	// kafka
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+}
+
+// NewSinks builds the configured sinks. If no sinks are configured, it
+// falls back to a single file sink rooted at "timeSeries", matching rtop's
+// historical behavior.
+func NewSinks(configs []SinkConfig) ([]Sink, error) {
+	if len(configs) == 0 {
+		return []Sink{NewFileSink("timeSeries")}, nil
+	}
+
+	var sinks []Sink
+	for _, c := range configs {
+		switch c.Type {
+		case "file", "":
+			dir := c.Dir
+			if dir == "" {
+				dir = "timeSeries"
+			}
+			sinks = append(sinks, NewFileSink(dir))
+		case "influxdb":
+			sinks = append(sinks, NewInfluxDBSink(c.URL, c.Database))
+		case "prometheus":
+			sinks = append(sinks, NewPrometheusSink(c.Listen))
+		case "kafka":
+			sinks = append(sinks, NewKafkaSink(c.Brokers, c.Topic))
+		default:
+			return nil, fmt.Errorf("unknown sink type %q", c.Type)
+		}
+	}
+	return sinks, nil
+}
+
+// writeAll fans a collection out to every sink, logging (but not
+// propagating) individual sink failures so that one broken sink can't take
+// down the collection loop for a host.
+func writeAll(sinks []Sink, host string, s Stats) {
+	for _, sink := range sinks {
+		if err := sink.Write(host, s); err != nil {
+			fmt.Printf("sink write failed for %s: %s\n", host, err)
+		}
+	}
+}
+
+// numericMetricValue tries to read a collector's raw value as a single
+// float64, as required by both the Prometheus and InfluxDB sinks.
+// Collector output is typically a whole command's stdout, so this only
+// succeeds for collectors that were written to emit one bare number.
+func numericMetricValue(value interface{}) (float64, bool) {
+	s := strings.TrimSpace(fmt.Sprintf("%v", value))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// influxEscaper escapes the characters InfluxDB line protocol treats as
+// structural in a measurement name or tag value: commas (field separator),
+// spaces (field separator), and equals signs (tag key/value separator).
+// Collector names and hostnames are free-form text, not line-protocol
+// identifiers, so this runs on both before they're merged into a line.
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func influxEscape(s string) string {
+	return influxEscaper.Replace(s)
+}
+
+// prometheusMetricNameRe matches any character that Prometheus metric
+// names are not allowed to contain: https://prometheus.io/docs/concepts/data_model
+var prometheusMetricNameRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// prometheusMetricName sanitizes a collector name (free-form YAML text,
+// e.g. "CPU Usage") into a valid Prometheus metric name segment.
+func prometheusMetricName(collector string) string {
+	name := prometheusMetricNameRe.ReplaceAllString(collector, "_")
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func closeAll(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			fmt.Printf("sink close failed: %s\n", err)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------
+// file sink - preserves the original timeSeries/<host>/<unix>.json layout
+
+type FileSink struct {
+	baseDir string
+}
+
+func NewFileSink(baseDir string) *FileSink {
+	return &FileSink{baseDir: baseDir}
+}
+
+func (f *FileSink) Write(host string, s Stats) error {
+	dir := filepath.Join(f.baseDir, host)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", s.Time.Unix()))
+	return ioutil.WriteFile(path, file, 0644)
+}
+
+func (f *FileSink) Close() error {
+	return nil
+}
+
+//----------------------------------------------------------------------------
+// influxdb sink - batches points using the line-protocol HTTP write API
+
+type InfluxDBSink struct {
+	url      string
+	database string
+	client   *http.Client
+}
+
+func NewInfluxDBSink(url, database string) *InfluxDBSink {
+	return &InfluxDBSink{
+		url:      url,
+		database: database,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (i *InfluxDBSink) Write(host string, s Stats) error {
+	var buf bytes.Buffer
+	ts := s.Time.UnixNano()
+	for collector, value := range s.Collections {
+		measurement := influxEscape(collector)
+		tagValue := influxEscape(host)
+		if f, ok := numericMetricValue(value); ok {
+			fmt.Fprintf(&buf, "%s,host=%s value=%s %d\n", measurement, tagValue, strconv.FormatFloat(f, 'g', -1, 64), ts)
+		} else {
+			fmt.Fprintf(&buf, "%s,host=%s value=%q %d\n", measurement, tagValue, fmt.Sprintf("%v", value), ts)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	endpoint := fmt.Sprintf("%s/write?db=%s", i.url, i.database)
+	resp, err := i.client.Post(endpoint, "application/octet-stream", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influxdb write returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (i *InfluxDBSink) Close() error {
+	return nil
+}
+
+//----------------------------------------------------------------------------
+// prometheus sink - exposes the most recent value per host+metric on a
+// text-format /metrics endpoint
+
+type PrometheusSink struct {
+	mu     sync.Mutex
+	latest map[string]map[string]float64 // host -> collector -> numeric value
+	server *http.Server
+}
+
+func NewPrometheusSink(listen string) *PrometheusSink {
+	p := &PrometheusSink{
+		latest: make(map[string]map[string]float64),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	p.server = &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("prometheus sink: %s\n", err)
+		}
+	}()
+	return p
+}
+
+// Write records the numeric collectors in s, skipping any whose raw value
+// isn't a single number -- Collections often holds a whole command's
+// stdout, and the Prometheus text-exposition format has no way to express
+// that as a sample.
+func (p *PrometheusSink) Write(host string, s Stats) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for collector, value := range s.Collections {
+		f, ok := numericMetricValue(value)
+		if !ok {
+			continue
+		}
+		if p.latest[host] == nil {
+			p.latest[host] = make(map[string]float64)
+		}
+		p.latest[host][collector] = f
+	}
+	return nil
+}
+
+func (p *PrometheusSink) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host, collectors := range p.latest {
+		for collector, value := range collectors {
+			fmt.Fprintf(w, "rtop_%s{host=%q} %s\n", prometheusMetricName(collector), host, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+}
+
+func (p *PrometheusSink) Close() error {
+	return p.server.Close()
+}
+
+//----------------------------------------------------------------------------
+// kafka sink - emits one JSON message per collection round
+
+type kafkaMessage struct {
+	Host  string    `json:"host"`
+	Stats Stats     `json:"stats"`
+	Time  time.Time `json:"time"`
+}
+
+type KafkaSink struct {
+	brokers  []string
+	topic    string
+	producer kafkaProducer
+}
+
+// kafkaProducer is the minimal surface rtop needs from a Kafka client,
+// kept as an interface so the client library behind it can be swapped
+// without touching the rest of the sink.
+type kafkaProducer interface {
+	SendMessage(topic string, key string, value []byte) error
+	Close() error
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{
+		brokers:  brokers,
+		topic:    topic,
+		producer: newWriterKafkaProducer(brokers),
+	}
+}
+
+func (k *KafkaSink) Write(host string, s Stats) error {
+	msg := kafkaMessage{Host: host, Stats: s, Time: s.Time}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return k.producer.SendMessage(k.topic, host, payload)
+}
+
+func (k *KafkaSink) Close() error {
+	return k.producer.Close()
+}
+
+// writerKafkaProducer is the real kafkaProducer, backed by kafka-go's
+// batching Writer in its default synchronous mode: SendMessage blocks
+// until the write completes.
+type writerKafkaProducer struct {
+	writer *kafka.Writer
+}
+
+func newWriterKafkaProducer(brokers []string) *writerKafkaProducer {
+	return &writerKafkaProducer{
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Balancer: &kafka.LeastBytes{},
+		},
+	}
+}
+
+func (w *writerKafkaProducer) SendMessage(topic string, key string, value []byte) error {
+	return w.writer.WriteMessages(context.Background(), kafka.Message{
+		Topic: topic,
+		Key:   []byte(key),
+		Value: value,
+	})
+}
+
+func (w *writerKafkaProducer) Close() error {
+	return w.writer.Close()
+}
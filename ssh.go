@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"io/ioutil"
+)
+
+// generateBootstrapKey creates an ed25519 keypair for use in -b bootstrap
+// mode, writing the private half to bootstrap.key and returning the
+// authorized_keys-formatted public half. ed25519 replaces the old 4096-bit
+// RSA bootstrap key: smaller, faster to generate, and plenty strong for a
+// throwaway key that's removed from authorized_keys once real keys are in
+// place.
+func generateBootstrapKey() ([]byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "rtop bootstrap key")
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyFile, err := os.Create("bootstrap.key")
+	if err != nil {
+		return nil, err
+	}
+	defer privateKeyFile.Close()
+	if err := pem.Encode(privateKeyFile, block); err != nil {
+		return nil, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	pubBin := ssh.MarshalAuthorizedKey(sshPub)
+	if err := ioutil.WriteFile("bootstrap.key.pub", pubBin, 0655); err != nil {
+		return nil, err
+	}
+	return pubBin, nil
+}
+
+// sshConnect dials addr as user, trying each available auth method in
+// turn: an on-disk identity file (prompting for its passphrase if it's
+// encrypted), an ssh-agent, and finally an interactive password if
+// authMethod is "password". Host keys are checked against
+// ~/.ssh/known_hosts unless insecureHostKey is set, in which case
+// whatever key the server presents is accepted (first-time bootstrap
+// only).
+func sshConnect(user string, addr string, identityFile string, authMethod string, insecureHostKey bool) *ssh.Client {
+	var methods []ssh.AuthMethod
+
+	if signer := loadIdentityFile(identityFile); signer != nil {
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if signers := agentSigners(); len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return signers, nil
+		}))
+	}
+
+	if authMethod == "password" {
+		methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+			return promptPassword(fmt.Sprintf("Password for %s@%s: ", user, addr))
+		}))
+	}
+
+	if len(methods) == 0 {
+		fmt.Printf("no usable auth method for %s@%s (checked identity file, ssh-agent, password)\n", user, addr)
+		return nil
+	}
+
+	hostKeyCallback, err := buildHostKeyCallback(insecureHostKey)
+	if err != nil {
+		fmt.Printf("unable to set up host key verification: %s\n", err)
+		return nil
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		fmt.Printf("unable to connect to %s@%s: %s\n", user, addr, err)
+		return nil
+	}
+	return client
+}
+
+// sshConnectRetry calls sshConnect up to maxAttempts times, backing off
+// exponentially (250ms, 500ms, 1s, ...) between failed attempts. sshConnect
+// does not report why an attempt failed, so auth and host-key failures are
+// retried the same way as dial errors. It's used by the -n named-collection worker pool, where a single flaky
+// host shouldn't need a whole extra invocation to pick up.
+func sshConnectRetry(user string, addr string, identityFile string, authMethod string, insecureHostKey bool, maxAttempts int) *ssh.Client {
+	backoff := 250 * time.Millisecond
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		client := sshConnect(user, addr, identityFile, authMethod, insecureHostKey)
+		if client != nil {
+			return client
+		}
+		if attempt == maxAttempts {
+			break
+		}
+		fmt.Printf("retrying connection to %s@%s in %s (attempt %d/%d)\n", user, addr, backoff, attempt, maxAttempts)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return nil
+}
+
+// loadIdentityFile reads and parses path, prompting for a passphrase
+// (or reading SSH_KEY_PASSPHRASE) if the key is encrypted. Returns nil if
+// the file can't be used at all.
+func loadIdentityFile(path string) ssh.Signer {
+	if len(path) == 0 {
+		return nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer
+	}
+
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		fmt.Printf("unable to parse private key %s: %s\n", path, err)
+		return nil
+	}
+
+	passphrase := os.Getenv("SSH_KEY_PASSPHRASE")
+	if len(passphrase) == 0 {
+		var promptErr error
+		passphrase, promptErr = promptPassword(fmt.Sprintf("Passphrase for %s: ", path))
+		if promptErr != nil {
+			fmt.Printf("unable to read passphrase for %s: %s\n", path, promptErr)
+			return nil
+		}
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	if err != nil {
+		fmt.Printf("unable to decrypt private key %s: %s\n", path, err)
+		return nil
+	}
+	return signer
+}
+
+// agentSigners returns the keys held by a running ssh-agent, or nil if
+// SSH_AUTH_SOCK isn't set or can't be reached.
+func agentSigners() []ssh.Signer {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil
+	}
+	return signers
+}
+
+// promptPassword prints prompt and reads a line, hiding the input on a
+// TTY and falling back to plain line-reading otherwise (e.g. in tests or
+// when stdin is redirected).
+func promptPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	defer fmt.Println()
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		pw, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		return string(pw), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// buildHostKeyCallback returns a callback that verifies against
+// ~/.ssh/known_hosts, or one that accepts any host key if insecure is
+// true.
+func buildHostKeyCallback(insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	path := filepath.Join(currentUser.HomeDir, ".ssh", "known_hosts")
+	return knownhosts.New(path)
+}
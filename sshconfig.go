@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sshConfigEntry is one `Host` block parsed out of ~/.ssh/config.
+type sshConfigEntry struct {
+	host     string
+	hostName string
+	port     int
+	user     string
+	identity string
+}
+
+var sshConfigEntries []sshConfigEntry
+
+// parseSshConfig loads and parses the given ssh_config file into
+// sshConfigEntries. It returns false if the file could not be read.
+func parseSshConfig(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	sshConfigEntries = nil
+	var cur *sshConfigEntry
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		value := strings.Join(fields[1:], " ")
+
+		switch key {
+		case "host":
+			sshConfigEntries = append(sshConfigEntries, sshConfigEntry{host: value})
+			cur = &sshConfigEntries[len(sshConfigEntries)-1]
+		case "hostname":
+			if cur != nil {
+				cur.hostName = value
+			}
+		case "port":
+			if cur != nil {
+				cur.port, _ = strconv.Atoi(value)
+			}
+		case "user":
+			if cur != nil {
+				cur.user = value
+			}
+		case "identityfile":
+			if cur != nil {
+				cur.identity = value
+			}
+		}
+	}
+	return true
+}
+
+// getSshEntry returns the hostname, port, user and identity file recorded
+// for host in the parsed ssh_config, if any.
+func getSshEntry(host string) (hostName string, port int, user string, identity string) {
+	for _, e := range sshConfigEntries {
+		if e.host == host {
+			return e.hostName, e.port, e.user, e.identity
+		}
+	}
+	return "", 0, "", ""
+}